@@ -0,0 +1,91 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DescriptorKind classifies a descriptor according to what umoci can
+// actually do with it when resolving a reference.
+type DescriptorKind int
+
+const (
+	// DescriptorKindManifest is a descriptor whose media type is registered
+	// as MediaTypeKindManifest (ispec.MediaTypeImageManifest, a Docker v2
+	// manifest, ...) -- a valid, terminal resolution of a reference.
+	DescriptorKindManifest DescriptorKind = iota
+
+	// DescriptorKindIndex is a descriptor whose media type is registered as
+	// MediaTypeKindIndex (ispec.MediaTypeImageIndex, a Docker v2 manifest
+	// list, ...) -- it must be descended into to find the manifests (or
+	// further indexes) it references.
+	DescriptorKindIndex
+
+	// DescriptorKindUnknown is a descriptor whose media type is not one
+	// umoci recognises at all. It is treated as a possible (forward
+	// compatible) resolution, since umoci cannot tell whether it is a valid
+	// ref target or not.
+	DescriptorKindUnknown
+
+	// DescriptorKindInvalid is a descriptor whose media type is known to
+	// umoci, but which can never semantically be a ref target -- such as an
+	// image config or layer blob being tagged directly.
+	DescriptorKindInvalid
+)
+
+// String returns a human-readable name for the given DescriptorKind.
+func (k DescriptorKind) String() string {
+	switch k {
+	case DescriptorKindManifest:
+		return "manifest"
+	case DescriptorKindIndex:
+		return "index"
+	case DescriptorKindUnknown:
+		return "unknown"
+	case DescriptorKindInvalid:
+		return "invalid"
+	default:
+		return "unknown DescriptorKind"
+	}
+}
+
+// ClassifyDescriptor classifies d according to what umoci can do with it
+// when resolving a reference -- see DescriptorKind for the possible
+// classifications. It consults the same media type registry as
+// RegisterMediaType, so descriptors using a registered Docker v2 (or other
+// downstream-registered) media type are classified the same way as their
+// OCI equivalents.
+func ClassifyDescriptor(d ispec.Descriptor) DescriptorKind {
+	if d.MediaType == ispec.MediaTypeDescriptor {
+		return DescriptorKindInvalid
+	}
+
+	kind, ok := lookupMediaTypeKind(d.MediaType)
+	if !ok {
+		return DescriptorKindUnknown
+	}
+	switch kind {
+	case MediaTypeKindManifest:
+		return DescriptorKindManifest
+	case MediaTypeKindIndex:
+		return DescriptorKindIndex
+	default: // MediaTypeKindConfig, MediaTypeKindLayer
+		return DescriptorKindInvalid
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// TestResolveReferenceStrictRejectsInvalidTarget verifies that
+// ResolveReferenceStrict hard-fails when a ref resolves to a descriptor that
+// classifies as DescriptorKindInvalid (a config blob tagged directly),
+// while the non-strict ResolveReference skips the same entry (logging a
+// warning) and returns no resolutions.
+func TestResolveReferenceStrictRejectsInvalidTarget(t *testing.T) {
+	e := newTestEngine(t)
+	ctx := context.Background()
+
+	config := e.putBlobJSON(t, ispec.MediaTypeImageConfig, struct{}{})
+	config.MediaType = ispec.MediaTypeImageConfig
+	config.Annotations = map[string]string{ispec.AnnotationRefName: "bogus"}
+
+	e.setIndex(t, config)
+
+	if _, err := e.ResolveReferenceStrict(ctx, "bogus"); err == nil {
+		t.Fatalf("expected ResolveReferenceStrict to reject a config blob tagged directly")
+	}
+
+	descriptors, err := e.ResolveReference(ctx, "bogus")
+	if err != nil {
+		t.Fatalf("ResolveReference: %v", err)
+	}
+	if len(descriptors) != 0 {
+		t.Fatalf("expected ResolveReference to skip the invalid target, got %+v", descriptors)
+	}
+}
+
+// TestResolveReferenceStrictAcceptsValidTarget verifies that
+// ResolveReferenceStrict resolves an ordinary manifest tag the same way
+// ResolveReference does.
+func TestResolveReferenceStrictAcceptsValidTarget(t *testing.T) {
+	e := newTestEngine(t)
+	ctx := context.Background()
+
+	manifest := e.putBlobJSON(t, ispec.MediaTypeImageManifest, ispec.Manifest{
+		Config: ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig},
+	})
+	manifest.MediaType = ispec.MediaTypeImageManifest
+	manifest.Annotations = map[string]string{ispec.AnnotationRefName: "latest"}
+
+	e.setIndex(t, manifest)
+
+	descriptors, err := e.ResolveReferenceStrict(ctx, "latest")
+	if err != nil {
+		t.Fatalf("ResolveReferenceStrict: %v", err)
+	}
+	if len(descriptors) != 1 || descriptors[0].Digest != manifest.Digest {
+		t.Fatalf("expected the tagged manifest to resolve, got %+v", descriptors)
+	}
+}
+
+// TestClassifyDescriptorRegisteredMediaType verifies that ClassifyDescriptor
+// consults the RegisterMediaType registry for media types it doesn't know
+// about natively.
+func TestClassifyDescriptorRegisteredMediaType(t *testing.T) {
+	const customMediaType = "application/vnd.example.custom-index+json"
+	RegisterMediaType(customMediaType, MediaTypeKindIndex)
+
+	got := ClassifyDescriptor(ispec.Descriptor{MediaType: customMediaType})
+	if got != DescriptorKindIndex {
+		t.Fatalf("expected a registered index media type to classify as DescriptorKindIndex, got %v", got)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Engine is the minimal stand-in for casext's real CAS-backed Engine type
+// (not present in this tree) needed to drive the exported Engine methods in
+// this package's tests against an actual index/blob graph, rather than only
+// their unexported helpers.
+type Engine struct {
+	store *memStore
+}
+
+// memStore is an in-memory, content-addressed blob store backing the
+// Engine used by this package's tests. Engine methods take Engine by value
+// (matching the rest of casext), so memStore is held by pointer to make
+// mutations through GetIndex/PutIndex/PutBlobJSON visible to every copy of
+// the Engine under test.
+type memStore struct {
+	mu    sync.Mutex
+	index ispec.Index
+	blobs map[digest.Digest][]byte
+}
+
+// newTestEngine returns an Engine backed by an empty in-memory store,
+// suitable for driving the exported Engine methods in tests without a real
+// CAS backend.
+func newTestEngine(t *testing.T) Engine {
+	t.Helper()
+	return Engine{store: &memStore{blobs: map[digest.Digest][]byte{}}}
+}
+
+// putBlob stores blob under its own digest and returns the descriptor
+// referencing it, with mediaType set as given.
+func (e Engine) putBlob(t *testing.T, mediaType string, blob []byte) ispec.Descriptor {
+	t.Helper()
+	dgst := digest.FromBytes(blob)
+
+	e.store.mu.Lock()
+	e.store.blobs[dgst] = blob
+	e.store.mu.Unlock()
+
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(blob)),
+	}
+}
+
+// putBlobJSON is a test convenience wrapper around putBlob for JSON values.
+func (e Engine) putBlobJSON(t *testing.T, mediaType string, value interface{}) ispec.Descriptor {
+	t.Helper()
+	blob, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("marshal %T: %v", value, err)
+	}
+	return e.putBlob(t, mediaType, blob)
+}
+
+// setIndex replaces the top-level index with one containing the given root
+// entries.
+func (e Engine) setIndex(t *testing.T, roots ...ispec.Descriptor) {
+	t.Helper()
+	index := ispec.Index{Manifests: roots}
+	index.SchemaVersion = 2
+	if err := e.PutIndex(context.Background(), index); err != nil {
+		t.Fatalf("setIndex: %v", err)
+	}
+}
+
+func (e Engine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+	return e.store.index, nil
+}
+
+func (e Engine) PutIndex(ctx context.Context, index ispec.Index) error {
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+	e.store.index = index
+	return nil
+}
+
+func (e Engine) GetVerifiedBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	e.store.mu.Lock()
+	blob, ok := e.store.blobs[descriptor.Digest]
+	e.store.mu.Unlock()
+	if !ok {
+		return nil, errors.Errorf("blob %s not found", descriptor.Digest)
+	}
+	return io.NopCloser(bytes.NewReader(blob)), nil
+}
+
+func (e Engine) PutBlobJSON(ctx context.Context, value interface{}) (ispec.Descriptor, int64, error) {
+	blob, err := json.Marshal(value)
+	if err != nil {
+		return ispec.Descriptor{}, 0, errors.Wrap(err, "marshal blob")
+	}
+	dgst := digest.FromBytes(blob)
+
+	e.store.mu.Lock()
+	e.store.blobs[dgst] = blob
+	e.store.mu.Unlock()
+
+	return ispec.Descriptor{Digest: dgst, Size: int64(len(blob))}, int64(len(blob)), nil
+}
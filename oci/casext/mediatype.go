@@ -0,0 +1,115 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"sync"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Docker v2 media types that tools such as skopeo and buildkit frequently
+// write to an OCI layout without converting them to their OCI equivalents.
+// These are not part of the image-spec, so they aren't available as
+// constants from the ispec package.
+const (
+	MediaTypeDockerV2Manifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerV2ManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerV2ImageConfig  = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerV2Layer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// MediaTypeKind describes what role a media type plays in a manifest graph,
+// independent of which specification (OCI or Docker v2) defines it.
+type MediaTypeKind int
+
+const (
+	// MediaTypeKindManifest is a single-platform manifest, the terminal node
+	// of a manifest graph.
+	MediaTypeKindManifest MediaTypeKind = iota
+
+	// MediaTypeKindIndex is a multi-platform index (or manifest list),
+	// which must be descended into to reach the manifests it references.
+	MediaTypeKindIndex
+
+	// MediaTypeKindConfig is an image config blob.
+	MediaTypeKindConfig
+
+	// MediaTypeKindLayer is a filesystem layer blob.
+	MediaTypeKindLayer
+)
+
+// String returns a human-readable name for the given MediaTypeKind.
+func (k MediaTypeKind) String() string {
+	switch k {
+	case MediaTypeKindManifest:
+		return "manifest"
+	case MediaTypeKindIndex:
+		return "index"
+	case MediaTypeKindConfig:
+		return "config"
+	case MediaTypeKindLayer:
+		return "layer"
+	default:
+		return "unknown MediaTypeKind"
+	}
+}
+
+var (
+	mediaTypeRegistryMu sync.RWMutex
+
+	// mediaTypeRegistry maps a media type to the role it plays in a
+	// manifest graph. Both ClassifyDescriptor and the Walk implementation
+	// consult this registry -- it is seeded with the OCI media types as
+	// well as their Docker v2 equivalents, since real-world OCI layouts
+	// frequently contain the latter.
+	mediaTypeRegistry = map[string]MediaTypeKind{
+		ispec.MediaTypeImageManifest:                  MediaTypeKindManifest,
+		ispec.MediaTypeImageIndex:                     MediaTypeKindIndex,
+		ispec.MediaTypeImageConfig:                    MediaTypeKindConfig,
+		ispec.MediaTypeImageLayer:                     MediaTypeKindLayer,
+		ispec.MediaTypeImageLayerGzip:                 MediaTypeKindLayer,
+		ispec.MediaTypeImageLayerNonDistributable:     MediaTypeKindLayer,
+		ispec.MediaTypeImageLayerNonDistributableGzip: MediaTypeKindLayer,
+		MediaTypeDockerV2Manifest:                     MediaTypeKindManifest,
+		MediaTypeDockerV2ManifestList:                 MediaTypeKindIndex,
+		MediaTypeDockerV2ImageConfig:                  MediaTypeKindConfig,
+		MediaTypeDockerV2Layer:                        MediaTypeKindLayer,
+	}
+)
+
+// RegisterMediaType teaches casext about a new media type, so that
+// ClassifyDescriptor and Walk know how to handle it without requiring
+// downstream projects to fork umoci. This is intended for artifact types
+// that umoci has no special support for (helm charts, WASM modules, and so
+// on) but which still participate in a manifest or index graph the same way
+// an OCI manifest does.
+func RegisterMediaType(mediaType string, kind MediaTypeKind) {
+	mediaTypeRegistryMu.Lock()
+	defer mediaTypeRegistryMu.Unlock()
+	mediaTypeRegistry[mediaType] = kind
+}
+
+// lookupMediaTypeKind returns the MediaTypeKind registered for mediaType, and
+// whether an entry was found at all.
+func lookupMediaTypeKind(mediaType string) (MediaTypeKind, bool) {
+	mediaTypeRegistryMu.RLock()
+	defer mediaTypeRegistryMu.RUnlock()
+	kind, ok := mediaTypeRegistry[mediaType]
+	return kind, ok
+}
@@ -0,0 +1,231 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// subjectManifest is a partial copy of ispec.Manifest and ispec.Index that
+// additionally decodes the OCI 1.1 "subject" field. The version of
+// image-spec vendored here predates the addition of Subject to the upstream
+// types, so we cannot rely on ispec.Manifest/ispec.Index to round-trip it --
+// this type exists solely so that ParseSubject can be written without
+// forking the vendored spec.
+type subjectManifest struct {
+	MediaType    string            `json:"mediaType,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Config       *ispec.Descriptor `json:"config,omitempty"`
+	Subject      *ispec.Descriptor `json:"subject,omitempty"`
+}
+
+// fetchBlob reads the full contents of the blob referenced by descriptor.
+func fetchBlob(ctx context.Context, engine Engine, descriptor ispec.Descriptor) ([]byte, error) {
+	reader, err := engine.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer reader.Close()
+
+	blob, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read blob %s", descriptor.Digest)
+	}
+	return blob, nil
+}
+
+// parseSubjectManifestBytes decodes blob as a subjectManifest.
+func parseSubjectManifestBytes(blob []byte) (subjectManifest, error) {
+	var manifest subjectManifest
+	if err := json.Unmarshal(blob, &manifest); err != nil {
+		return subjectManifest{}, errors.Wrap(err, "unmarshal manifest")
+	}
+	return manifest, nil
+}
+
+// decodeSubjectManifest fetches and decodes the blob referenced by
+// descriptor as a subjectManifest. descriptor.MediaType is not consulted --
+// the blob is decoded generically so that both known and forward-compatible
+// manifest-like media types are handled.
+func decodeSubjectManifest(ctx context.Context, engine Engine, descriptor ispec.Descriptor) (subjectManifest, error) {
+	blob, err := fetchBlob(ctx, engine, descriptor)
+	if err != nil {
+		return subjectManifest{}, err
+	}
+	manifest, err := parseSubjectManifestBytes(blob)
+	if err != nil {
+		return subjectManifest{}, errors.Wrapf(err, "%s", descriptor.Digest)
+	}
+	return manifest, nil
+}
+
+// ParseSubject decodes the blob referenced by descriptor as either an image
+// manifest or an image index, and returns its "subject" field (or nil, if
+// the blob has no subject).
+func ParseSubject(ctx context.Context, engine Engine, descriptor ispec.Descriptor) (*ispec.Descriptor, error) {
+	manifest, err := decodeSubjectManifest(ctx, engine, descriptor)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Subject, nil
+}
+
+// effectiveArtifactType returns manifest's artifact type for the purposes of
+// Referrers filtering. If the manifest does not set ArtifactType directly,
+// the config's mediaType is used instead -- this mirrors the fallback
+// behaviour described by the OCI 1.1 distribution-spec, since not all
+// registries populate ArtifactType.
+func (manifest subjectManifest) effectiveArtifactType() string {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType
+	}
+	if manifest.Config != nil {
+		return manifest.Config.MediaType
+	}
+	return ""
+}
+
+// referrersFallbackTag returns the fallback tag used to expose the
+// referrers of subjectDigest to registries that do not implement the OCI
+// 1.1 referrers API, per the "referrers tag schema" described in the
+// distribution-spec: "<algorithm>-<encoded>".
+func referrersFallbackTag(subjectDigest digest.Digest) string {
+	return fmt.Sprintf("%s-%s", subjectDigest.Algorithm(), subjectDigest.Encoded())
+}
+
+// subjectOfBlob interprets blob as the subject-bearing manifest or index
+// that descriptor's kind (see ClassifyDescriptor) says it should be, and
+// returns its "subject" field (or nil, if it has none).
+//
+// DescriptorKindInvalid blobs (config and layer blobs) can never carry a
+// subject and are rejected without even looking at their contents.
+// DescriptorKindUnknown blobs are tried on a best-effort basis: since this
+// bucket also contains binary artifacts that were never JSON in the first
+// place (a WASM module, a helm chart, ...), a decode failure there is
+// treated as "no subject" rather than a hard error -- the same
+// forward-compatible treatment casext gives unrecognised media types
+// elsewhere -- so that one foreign, non-JSON artifact elsewhere in the store
+// cannot abort referrer discovery for the whole image.
+func subjectOfBlob(kind DescriptorKind, blob []byte) (subjectManifest, error) {
+	if kind == DescriptorKindInvalid {
+		return subjectManifest{}, nil
+	}
+	manifest, err := parseSubjectManifestBytes(blob)
+	if err != nil {
+		if kind == DescriptorKindUnknown {
+			return subjectManifest{}, nil
+		}
+		return subjectManifest{}, err
+	}
+	return manifest, nil
+}
+
+// Referrers returns the set of manifests and indexes in the image that have
+// a "subject" field pointing at subjectDigest, optionally filtered by
+// artifactType (matched against the referrer's own ArtifactType field, or
+// its config's mediaType if ArtifactType is unset -- registries differ on
+// which of these they populate, so both are honoured here). An empty
+// artifactType matches any referrer.
+//
+// The top-level index is walked recursively (including any indexes it
+// references) so that referrers nested inside an image index -- as well as
+// referrers living alongside ordinary tagged manifests -- are all found.
+// Descriptors are classified with ClassifyDescriptor rather than compared
+// directly against the OCI media type constants, so Docker v2 manifests and
+// manifest lists (and any other media type taught to casext via
+// RegisterMediaType) are considered candidate referrers the same way their
+// OCI equivalents are.
+//
+// Only DescriptorKindIndex descriptors are descended into: a manifest's own
+// config and layers can never carry a subject, so there is nothing below it
+// worth walking into (or fetching -- a layer blob can be gigabytes).
+func (e Engine) Referrers(ctx context.Context, subjectDigest digest.Digest, artifactType string) ([]ispec.Descriptor, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	var referrers []ispec.Descriptor
+	for _, root := range index.Manifests {
+		if err := e.Walk(ctx, root, func(descriptor ispec.Descriptor) error {
+			kind := ClassifyDescriptor(descriptor)
+			if kind == DescriptorKindInvalid {
+				return ErrSkipDescriptor
+			}
+
+			blob, err := fetchBlob(ctx, e, descriptor)
+			if err != nil {
+				return err
+			}
+			manifest, err := subjectOfBlob(kind, blob)
+			if err != nil {
+				return errors.Wrapf(err, "decode %s", descriptor.Digest)
+			}
+			if manifest.Subject != nil && manifest.Subject.Digest == subjectDigest {
+				if artifactType == "" || manifest.effectiveArtifactType() == artifactType {
+					referrers = append(referrers, descriptor)
+				}
+			}
+
+			if kind == DescriptorKindIndex {
+				// Keep descending -- there may be further referrers nested
+				// inside this index.
+				return nil
+			}
+			// DescriptorKindManifest or DescriptorKindUnknown: nothing
+			// reachable below this descriptor can itself be a referrer.
+			return ErrSkipDescriptor
+		}); err != nil {
+			return nil, errors.Wrapf(err, "walk %s", root.Digest)
+		}
+	}
+	return referrers, nil
+}
+
+// PutReferrersIndex writes an image index listing the given referrer
+// descriptors and tags it with the fallback tag scheme
+// ("<algorithm>-<encoded>", e.g. "sha256-<hex>") derived from subjectDigest,
+// as an AnnotationRefName entry. This allows the referrers of subjectDigest
+// to be discovered by pulling that tag, for registries that do not
+// implement the OCI 1.1 referrers API natively.
+func (e Engine) PutReferrersIndex(ctx context.Context, subjectDigest digest.Digest, referrers []ispec.Descriptor) (ispec.Descriptor, error) {
+	index := ispec.Index{
+		MediaType: ispec.MediaTypeImageIndex,
+		Manifests: referrers,
+	}
+	index.SchemaVersion = 2
+
+	descriptor, _, err := e.PutBlobJSON(ctx, index)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put referrers index")
+	}
+	descriptor.MediaType = ispec.MediaTypeImageIndex
+
+	tag := referrersFallbackTag(subjectDigest)
+	if err := e.UpdateReference(ctx, tag, descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "update fallback tag %s", tag)
+	}
+	return descriptor, nil
+}
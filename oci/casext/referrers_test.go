@@ -0,0 +1,229 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+const testSubjectDigest = digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+
+// TestParseSubjectManifestBytesManifest verifies that a subject recorded on
+// an image manifest is decoded correctly.
+func TestParseSubjectManifestBytesManifest(t *testing.T) {
+	manifest, err := parseSubjectManifestBytes([]byte(`{
+		"mediaType": "` + ispec.MediaTypeImageManifest + `",
+		"artifactType": "application/vnd.example.sbom+json",
+		"subject": {"mediaType": "` + ispec.MediaTypeImageManifest + `", "digest": "` + string(testSubjectDigest) + `", "size": 42}
+	}`))
+	if err != nil {
+		t.Fatalf("parseSubjectManifestBytes: %v", err)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != testSubjectDigest {
+		t.Fatalf("expected subject digest %s, got %+v", testSubjectDigest, manifest.Subject)
+	}
+	if got := manifest.effectiveArtifactType(); got != "application/vnd.example.sbom+json" {
+		t.Fatalf("expected explicit artifactType to win, got %q", got)
+	}
+}
+
+// TestParseSubjectManifestBytesIndex verifies that a subject recorded on an
+// image index (rather than a manifest) is decoded correctly.
+func TestParseSubjectManifestBytesIndex(t *testing.T) {
+	manifest, err := parseSubjectManifestBytes([]byte(`{
+		"mediaType": "` + ispec.MediaTypeImageIndex + `",
+		"manifests": [],
+		"subject": {"mediaType": "` + ispec.MediaTypeImageManifest + `", "digest": "` + string(testSubjectDigest) + `", "size": 42}
+	}`))
+	if err != nil {
+		t.Fatalf("parseSubjectManifestBytes: %v", err)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != testSubjectDigest {
+		t.Fatalf("expected subject digest %s, got %+v", testSubjectDigest, manifest.Subject)
+	}
+}
+
+// TestEffectiveArtifactTypeFallback verifies that the config's mediaType is
+// used when ArtifactType is not set directly on the manifest.
+func TestEffectiveArtifactTypeFallback(t *testing.T) {
+	manifest := subjectManifest{Config: &ispec.Descriptor{MediaType: "application/vnd.example.config+json"}}
+	if got := manifest.effectiveArtifactType(); got != "application/vnd.example.config+json" {
+		t.Fatalf("expected config mediaType fallback, got %q", got)
+	}
+}
+
+// TestSubjectOfBlobInvalidIsSkipped verifies that DescriptorKindInvalid
+// blobs (config/layers) are never even decoded, regardless of their
+// contents.
+func TestSubjectOfBlobInvalidIsSkipped(t *testing.T) {
+	manifest, err := subjectOfBlob(DescriptorKindInvalid, []byte("this is not json at all"))
+	if err != nil {
+		t.Fatalf("expected no error for an invalid-kind descriptor, got %v", err)
+	}
+	if manifest.Subject != nil {
+		t.Fatalf("expected no subject, got %+v", manifest.Subject)
+	}
+}
+
+// TestSubjectOfBlobUnknownDegradesGracefully verifies that an unparseable
+// blob with an unrecognised (forward-compatible) media type is treated as
+// "no subject" rather than propagating a hard decode error -- so that one
+// foreign, non-JSON artifact (e.g. a WASM module) elsewhere in the store
+// cannot abort referrer discovery for the whole image.
+func TestSubjectOfBlobUnknownDegradesGracefully(t *testing.T) {
+	manifest, err := subjectOfBlob(DescriptorKindUnknown, []byte{0x00, 0x01, 0x02, 0x03})
+	if err != nil {
+		t.Fatalf("expected unparseable unknown-kind blob to degrade gracefully, got error: %v", err)
+	}
+	if manifest.Subject != nil {
+		t.Fatalf("expected no subject, got %+v", manifest.Subject)
+	}
+}
+
+// TestSubjectOfBlobManifestPropagatesError verifies that a blob known to be
+// a manifest or index that fails to decode is still a hard error -- only
+// DescriptorKindUnknown gets the forward-compatible treatment.
+func TestSubjectOfBlobManifestPropagatesError(t *testing.T) {
+	if _, err := subjectOfBlob(DescriptorKindManifest, []byte("not json")); err == nil {
+		t.Fatalf("expected a corrupt manifest blob to be a hard error")
+	}
+	if _, err := subjectOfBlob(DescriptorKindIndex, []byte("not json")); err == nil {
+		t.Fatalf("expected a corrupt index blob to be a hard error")
+	}
+}
+
+// TestReferrersFallbackTag verifies the "<algorithm>-<encoded>" fallback
+// tag scheme.
+func TestReferrersFallbackTag(t *testing.T) {
+	got := referrersFallbackTag(testSubjectDigest)
+	want := "sha256-1111111111111111111111111111111111111111111111111111111111111111"
+	if got != want {
+		t.Fatalf("referrersFallbackTag(%s) = %q, want %q", testSubjectDigest, got, want)
+	}
+}
+
+// TestSubjectOfBlobArtifactTypeFiltering exercises subjectOfBlob end-to-end
+// for both a manifest referrer and an index referrer of the same subject,
+// and verifies that the artifactType each decodes with can be used to tell
+// them apart -- this is the filtering Referrers itself applies once it has
+// found a matching subject.
+func TestSubjectOfBlobArtifactTypeFiltering(t *testing.T) {
+	subject := &ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: testSubjectDigest}
+
+	sbomManifest, err := subjectOfBlob(DescriptorKindManifest, mustMarshalSubjectManifest(t, subjectManifest{
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.sbom+json",
+		Subject:      subject,
+	}))
+	if err != nil {
+		t.Fatalf("subjectOfBlob(manifest): %v", err)
+	}
+
+	sigIndex, err := subjectOfBlob(DescriptorKindIndex, mustMarshalSubjectManifest(t, subjectManifest{
+		MediaType:    ispec.MediaTypeImageIndex,
+		ArtifactType: "application/vnd.example.signature",
+		Subject:      subject,
+	}))
+	if err != nil {
+		t.Fatalf("subjectOfBlob(index): %v", err)
+	}
+
+	if sbomManifest.Subject == nil || sbomManifest.Subject.Digest != testSubjectDigest {
+		t.Fatalf("sbom manifest: expected subject %s, got %+v", testSubjectDigest, sbomManifest.Subject)
+	}
+	if sigIndex.Subject == nil || sigIndex.Subject.Digest != testSubjectDigest {
+		t.Fatalf("signature index: expected subject %s, got %+v", testSubjectDigest, sigIndex.Subject)
+	}
+
+	if got := sbomManifest.effectiveArtifactType(); got != "application/vnd.example.sbom+json" {
+		t.Fatalf("expected sbom manifest artifactType, got %q", got)
+	}
+	if got := sigIndex.effectiveArtifactType(); got != "application/vnd.example.signature" {
+		t.Fatalf("expected signature index artifactType, got %q", got)
+	}
+}
+
+// TestReferrersEndToEnd drives Engine.Referrers end-to-end over a real
+// index/blob graph: a referrer manifest nested inside an index (to confirm
+// indexes are still descended into), plus a layer blob that was never
+// written to the store. If Referrers fetched the referrer manifest's own
+// layers (as it did before it started returning ErrSkipDescriptor once a
+// manifest had been classified and inspected), it would hard-fail trying to
+// fetch that missing blob.
+func TestReferrersEndToEnd(t *testing.T) {
+	e := newTestEngine(t)
+	ctx := context.Background()
+
+	missingLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000000"),
+		Size:      999,
+	}
+
+	// A real manifest, including a "layers" entry that was never written to
+	// the store -- Referrers must never try to fetch it.
+	referrer := e.putBlobJSON(t, ispec.MediaTypeImageManifest, struct {
+		ispec.Manifest
+		Subject *ispec.Descriptor `json:"subject,omitempty"`
+	}{
+		Manifest: ispec.Manifest{
+			MediaType:    ispec.MediaTypeImageManifest,
+			ArtifactType: "application/vnd.example.sbom+json",
+			Config:       ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig},
+			Layers:       []ispec.Descriptor{missingLayer},
+		},
+		Subject: &ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: testSubjectDigest},
+	})
+	referrer.MediaType = ispec.MediaTypeImageManifest
+
+	index := e.putBlobJSON(t, ispec.MediaTypeImageIndex, ispec.Index{Manifests: []ispec.Descriptor{referrer}})
+	index.MediaType = ispec.MediaTypeImageIndex
+	index.Annotations = map[string]string{ispec.AnnotationRefName: "latest"}
+
+	e.setIndex(t, index)
+
+	referrers, err := e.Referrers(ctx, testSubjectDigest, "")
+	if err != nil {
+		t.Fatalf("Referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != referrer.Digest {
+		t.Fatalf("expected the nested referrer manifest, got %+v", referrers)
+	}
+
+	filtered, err := e.Referrers(ctx, testSubjectDigest, "application/vnd.example.other")
+	if err != nil {
+		t.Fatalf("Referrers (filtered): %v", err)
+	}
+	if len(filtered) != 0 {
+		t.Fatalf("expected artifactType filter to exclude the referrer, got %+v", filtered)
+	}
+}
+
+func mustMarshalSubjectManifest(t *testing.T, manifest subjectManifest) []byte {
+	t.Helper()
+	blob, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("marshal subjectManifest: %v", err)
+	}
+	return blob
+}
@@ -24,17 +24,81 @@ import (
 	"golang.org/x/net/context"
 )
 
-// isKnownMediaType returns whether a media type is known by the spec. This
-// probably should be moved somewhere else to avoid going out of date.
-func isKnownMediaType(mediaType string) bool {
-	return mediaType == ispec.MediaTypeDescriptor ||
-		mediaType == ispec.MediaTypeImageManifest ||
-		mediaType == ispec.MediaTypeImageIndex ||
-		mediaType == ispec.MediaTypeImageLayer ||
-		mediaType == ispec.MediaTypeImageLayerGzip ||
-		mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
-		mediaType == ispec.MediaTypeImageConfig
+// ResolveReferenceOptions provides a set of restrictions to be applied when
+// resolving a reference name, on top of the usual refname matching. Any
+// fields left as the zero value are treated as "match anything".
+type ResolveReferenceOptions struct {
+	// Platform restricts resolution to manifests that match the given
+	// platform. OS and Architecture are required matches. Variant and
+	// OSVersion are only checked (as an exact match) if the corresponding
+	// field here is non-empty. OSFeatures is only checked if non-empty, in
+	// which case the filter's entries must all be present in the
+	// candidate's OSFeatures (a subset match). ispec.Platform has no other
+	// fields to match against at the version of image-spec vendored here.
+	Platform *ispec.Platform
+
+	// ArtifactType restricts resolution to manifests whose ArtifactType
+	// field matches exactly. If empty, manifests are not filtered by
+	// artifact type.
+	ArtifactType string
+
+	// Annotations restricts resolution to manifests whose Annotations
+	// contain all of the given key-value pairs. If empty, manifests are not
+	// filtered by annotation.
+	Annotations map[string]string
+}
+
+// matchPlatform returns whether candidate satisfies the restrictions placed
+// by filter. A nil filter matches any platform. A nil candidate also always
+// matches: it means the descriptor doesn't declare a platform at all (the
+// common case for an ordinary single-platform manifest, which has no
+// siblings to be disambiguated from), so there is nothing for filter to
+// meaningfully reject.
+func matchPlatform(filter *ispec.Platform, candidate *ispec.Platform) bool {
+	if filter == nil || candidate == nil {
+		return true
+	}
+	if filter.OS != candidate.OS || filter.Architecture != candidate.Architecture {
+		return false
+	}
+	if filter.Variant != "" && filter.Variant != candidate.Variant {
+		return false
+	}
+	if filter.OSVersion != "" && filter.OSVersion != candidate.OSVersion {
+		return false
+	}
+	if len(filter.OSFeatures) > 0 && !isSubset(filter.OSFeatures, candidate.OSFeatures) {
+		return false
+	}
+	return true
+}
+
+// isSubset returns whether every entry of needles is present in haystack.
+func isSubset(needles []string, haystack []string) bool {
+	set := make(map[string]struct{}, len(haystack))
+	for _, entry := range haystack {
+		set[entry] = struct{}{}
+	}
+	for _, needle := range needles {
+		if _, ok := set[needle]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchManifest returns whether the given manifest descriptor satisfies the
+// ArtifactType and Annotations restrictions of opts.
+func matchManifest(opts ResolveReferenceOptions, descriptor ispec.Descriptor) bool {
+	if opts.ArtifactType != "" && descriptor.ArtifactType != opts.ArtifactType {
+		return false
+	}
+	for key, value := range opts.Annotations {
+		if descriptor.Annotations[key] != value {
+			return false
+		}
+	}
+	return true
 }
 
 // ResolveReference will attempt to resolve all possible descriptor paths to
@@ -45,10 +109,41 @@ func isKnownMediaType(mediaType string) bool {
 // "org.opencontainers.image.ref.name" descriptor annotation. It is recommended
 // that if the returned slice of descriptors is greater than zero that the user
 // be consulted to resolve the conflict (due to ambiguity in resolution paths).
-//
-// TODO: How are we meant to implement other restrictions such as the
-//       architecture and feature flags? The API will need to change.
 func (e Engine) ResolveReference(ctx context.Context, refname string) ([]ispec.Descriptor, error) {
+	return e.ResolveReferenceWithOptions(ctx, refname, ResolveReferenceOptions{})
+}
+
+// ResolveReferenceWithOptions is the generalised form of ResolveReference,
+// which also restricts the set of returned descriptors to those that match
+// opts. This allows (for instance) a caller to resolve a multi-architecture
+// tag down to the single manifest that matches the host platform, without
+// having to post-process the result of ResolveReference by hand.
+//
+// opts.Platform only restricts candidates that actually declare a Platform:
+// a manifest with no Platform set (the common case for an ordinary
+// single-platform tag, which has nothing to disambiguate) always matches,
+// regardless of opts.Platform. Candidates reached through an image index's
+// Manifests entries do carry per-entry Platform information per the spec,
+// so a multi-architecture tag is still correctly narrowed down to the
+// entry matching the host platform. ArtifactType and Annotations are
+// checked uniformly, regardless of how the manifest was reached.
+func (e Engine) ResolveReferenceWithOptions(ctx context.Context, refname string, opts ResolveReferenceOptions) ([]ispec.Descriptor, error) {
+	return e.resolveReference(ctx, refname, opts, false)
+}
+
+// ResolveReferenceStrict is identical to ResolveReference, except that it
+// returns an error if any candidate resolution of refname (a top-level entry
+// for refname, or an entry of an index reached from one) classifies as
+// DescriptorKindInvalid (see ClassifyDescriptor), rather than skipping it
+// with a logged warning. The config and layers of a resolved manifest are
+// not checked. Callers that want to fail fast on a corrupt or maliciously
+// crafted ref -- rather than ignoring the bogus entry -- should use this
+// instead of ResolveReference.
+func (e Engine) ResolveReferenceStrict(ctx context.Context, refname string) ([]ispec.Descriptor, error) {
+	return e.resolveReference(ctx, refname, ResolveReferenceOptions{}, true)
+}
+
+func (e Engine) resolveReference(ctx context.Context, refname string, opts ResolveReferenceOptions, strict bool) ([]ispec.Descriptor, error) {
 	index, err := e.GetIndex(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "get top-level index")
@@ -72,16 +167,31 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]ispec.D
 	var resolutions []ispec.Descriptor
 	for _, root := range roots {
 		// Find all manifests or other blobs that are reachable from the given
-		// descriptor.
+		// descriptor. Note that when Walk recurses into an image index, the
+		// descriptor passed to walkFunc for each entry is the index's own
+		// Manifests[i] descriptor -- which is where Platform actually lives
+		// per the spec -- so we don't need any extra bookkeeping to apply
+		// opts.Platform to manifests reached through an index.
 		if err := e.Walk(ctx, root, func(descriptor ispec.Descriptor) error {
-			// It is very important that we do not ignore unknown media types
-			// here. We only recurse into mediaTypes that are *known* and are
-			// also not ispec.MediaTypeImageManifest.
-			if isKnownMediaType(descriptor.MediaType) && descriptor.MediaType != ispec.MediaTypeImageManifest {
+			switch kind := ClassifyDescriptor(descriptor); kind {
+			case DescriptorKindIndex:
+				// Keep recursing -- the index's own entries will be
+				// reclassified individually.
 				return nil
+			case DescriptorKindInvalid:
+				if strict {
+					return errors.Errorf("descriptor %s has media type %q which cannot be a ref target", descriptor.Digest, descriptor.MediaType)
+				}
+				log.Warnf("ignoring descriptor %s with media type %q reachable from ref %q -- it cannot be a ref target", descriptor.Digest, descriptor.MediaType, refname)
+				return ErrSkipDescriptor
+			case DescriptorKindManifest:
+				if !matchPlatform(opts.Platform, descriptor.Platform) || !matchManifest(opts, descriptor) {
+					return ErrSkipDescriptor
+				}
 			}
 
-			// Add the resolution and do not recurse any deeper.
+			// Add the resolution (DescriptorKindManifest or
+			// DescriptorKindUnknown) and do not recurse any deeper.
 			resolutions = append(resolutions, descriptor)
 			return ErrSkipDescriptor
 		}); err != nil {
@@ -91,6 +201,7 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]ispec.D
 
 	log.WithFields(log.Fields{
 		"refs": resolutions,
+		"opts": opts,
 	}).Debugf("casext.ResolveReference(%s) got these descriptors", refname)
 	return resolutions, nil
 }
@@ -99,6 +210,15 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]ispec.D
 // descriptor. If there are multiple descriptors that match the refname they
 // are all replaced with the given descriptor.
 func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
+	return e.UpdateReferenceWithOptions(ctx, refname, descriptor, ResolveReferenceOptions{})
+}
+
+// UpdateReferenceWithOptions is the generalised form of UpdateReference,
+// which only touches existing entries for refname that also match opts --
+// entries for other platforms (or artifact types, or annotations) are left
+// untouched. This allows a single-platform tag entry to be updated in a
+// multi-architecture image without clobbering its siblings.
+func (e Engine) UpdateReferenceWithOptions(ctx context.Context, refname string, descriptor ispec.Descriptor, opts ResolveReferenceOptions) error {
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
 	if err != nil {
@@ -107,12 +227,15 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 
 	// TODO: Handle refname = "".
 	var newIndex []ispec.Descriptor
-	for _, descriptor := range index.Manifests {
-		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
-			newIndex = append(newIndex, descriptor)
+	var numMatched int
+	for _, entry := range index.Manifests {
+		if entry.Annotations[ispec.AnnotationRefName] == refname && matchPlatform(opts.Platform, entry.Platform) && matchManifest(opts, entry) {
+			numMatched++
+			continue
 		}
+		newIndex = append(newIndex, entry)
 	}
-	if len(newIndex)-len(index.Manifests) > 1 {
+	if numMatched > 1 {
 		// Warn users if the operation is going to remove more than one references.
 		log.Warn("multiple references match the given reference name -- all of them have been replaced due to this ambiguity")
 	}
@@ -173,6 +296,13 @@ func (e Engine) AddReferences(ctx context.Context, refname string, descriptors .
 // DeleteReference removes all entries in the index that match the given
 // refname.
 func (e Engine) DeleteReference(ctx context.Context, refname string) error {
+	return e.DeleteReferenceWithOptions(ctx, refname, ResolveReferenceOptions{})
+}
+
+// DeleteReferenceWithOptions is the generalised form of DeleteReference,
+// which only removes entries for refname that also match opts -- entries for
+// other platforms (or artifact types, or annotations) are left untouched.
+func (e Engine) DeleteReferenceWithOptions(ctx context.Context, refname string, opts ResolveReferenceOptions) error {
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
 	if err != nil {
@@ -181,12 +311,15 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 
 	// TODO: Handle refname = "".
 	var newIndex []ispec.Descriptor
-	for _, descriptor := range index.Manifests {
-		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
-			newIndex = append(newIndex, descriptor)
+	var numMatched int
+	for _, entry := range index.Manifests {
+		if entry.Annotations[ispec.AnnotationRefName] == refname && matchPlatform(opts.Platform, entry.Platform) && matchManifest(opts, entry) {
+			numMatched++
+			continue
 		}
+		newIndex = append(newIndex, entry)
 	}
-	if len(newIndex)-len(index.Manifests) > 1 {
+	if numMatched > 1 {
 		// Warn users if the operation is going to remove more than one references.
 		log.Warn("multiple references match the given reference name -- all of them have been deleted due to this ambiguity")
 	}
@@ -217,4 +350,4 @@ func (e Engine) ListReferences(ctx context.Context) ([]string, error) {
 		}
 	}
 	return refs, nil
-}
\ No newline at end of file
+}
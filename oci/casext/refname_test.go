@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// TestResolveReferenceWithOptionsSinglePlatformTag verifies that an ordinary
+// single-platform tag -- a top-level index entry pointing directly at a
+// manifest, with no Platform set on it and no wrapping index -- still
+// resolves when a Platform filter is given. This is the common case: most
+// single-arch images have nothing to disambiguate, so they must not be
+// treated as a non-match just because they don't declare a platform.
+func TestResolveReferenceWithOptionsSinglePlatformTag(t *testing.T) {
+	e := newTestEngine(t)
+	ctx := context.Background()
+
+	manifest := e.putBlobJSON(t, ispec.MediaTypeImageManifest, ispec.Manifest{
+		Config: ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig},
+	})
+	manifest.MediaType = ispec.MediaTypeImageManifest
+	manifest.Annotations = map[string]string{ispec.AnnotationRefName: "latest"}
+
+	e.setIndex(t, manifest)
+
+	descriptors, err := e.ResolveReferenceWithOptions(ctx, "latest", ResolveReferenceOptions{
+		Platform: &ispec.Platform{OS: "linux", Architecture: "amd64"},
+	})
+	if err != nil {
+		t.Fatalf("ResolveReferenceWithOptions: %v", err)
+	}
+	if len(descriptors) != 1 || descriptors[0].Digest != manifest.Digest {
+		t.Fatalf("expected the single untagged-platform manifest to resolve, got %+v", descriptors)
+	}
+}
+
+// TestResolveReferenceWithOptionsMultiArchIndex verifies that a
+// multi-architecture tag pointing at an image index is correctly narrowed
+// down to the single manifest matching the host platform, using the
+// Platform carried by the index's own Manifests entries.
+func TestResolveReferenceWithOptionsMultiArchIndex(t *testing.T) {
+	e := newTestEngine(t)
+	ctx := context.Background()
+
+	amd64Manifest := e.putBlobJSON(t, ispec.MediaTypeImageManifest, ispec.Manifest{
+		Config: ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig},
+	})
+	amd64Manifest.MediaType = ispec.MediaTypeImageManifest
+	amd64Manifest.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	arm64Manifest := e.putBlobJSON(t, ispec.MediaTypeImageManifest, ispec.Manifest{
+		Config: ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig},
+	})
+	arm64Manifest.MediaType = ispec.MediaTypeImageManifest
+	arm64Manifest.Platform = &ispec.Platform{OS: "linux", Architecture: "arm64"}
+
+	index := e.putBlobJSON(t, ispec.MediaTypeImageIndex, ispec.Index{
+		Manifests: []ispec.Descriptor{amd64Manifest, arm64Manifest},
+	})
+	index.MediaType = ispec.MediaTypeImageIndex
+	index.Annotations = map[string]string{ispec.AnnotationRefName: "latest"}
+
+	e.setIndex(t, index)
+
+	descriptors, err := e.ResolveReferenceWithOptions(ctx, "latest", ResolveReferenceOptions{
+		Platform: &ispec.Platform{OS: "linux", Architecture: "arm64"},
+	})
+	if err != nil {
+		t.Fatalf("ResolveReferenceWithOptions: %v", err)
+	}
+	if len(descriptors) != 1 || descriptors[0].Digest != arm64Manifest.Digest {
+		t.Fatalf("expected only the arm64 sibling to resolve, got %+v", descriptors)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ErrSkipDescriptor is a special error that can be returned by a WalkFunc to
+// indicate that Walk should not recurse into the descriptor's children, but
+// should otherwise continue the walk (it is never returned by Walk itself).
+var ErrSkipDescriptor = errors.New("skip descriptor")
+
+// WalkFunc is the type of function passed to Walk. It is invoked once for
+// every descriptor reachable from the root descriptor passed to Walk
+// (including the root itself), in pre-order.
+type WalkFunc func(descriptor ispec.Descriptor) error
+
+// indexChildren is the subset of an OCI image index -- or a Docker v2
+// manifest list, which uses the same "manifests" field name -- needed to
+// find the descriptors it references.
+type indexChildren struct {
+	Manifests []ispec.Descriptor `json:"manifests,omitempty"`
+}
+
+// manifestChildren is the subset of an OCI image manifest -- or a Docker v2
+// manifest, which uses the same "config"/"layers" shape -- needed to find
+// the descriptors it references.
+type manifestChildren struct {
+	Config ispec.Descriptor   `json:"config"`
+	Layers []ispec.Descriptor `json:"layers,omitempty"`
+}
+
+// walkChildren decodes blob (the contents of a descriptor already
+// classified as kind) and returns the descriptors it references. Which
+// shape blob is decoded as is decided purely by kind -- the media-type
+// registry populated by RegisterMediaType -- rather than by a hardcoded
+// OCI-only media type switch, so Docker v2 manifest lists are descended
+// into exactly like an OCI image index.
+func walkChildren(kind MediaTypeKind, blob []byte) ([]ispec.Descriptor, error) {
+	switch kind {
+	case MediaTypeKindIndex:
+		var index indexChildren
+		if err := json.Unmarshal(blob, &index); err != nil {
+			return nil, errors.Wrap(err, "unmarshal index")
+		}
+		return index.Manifests, nil
+	case MediaTypeKindManifest:
+		var manifest manifestChildren
+		if err := json.Unmarshal(blob, &manifest); err != nil {
+			return nil, errors.Wrap(err, "unmarshal manifest")
+		}
+		children := append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+		return children, nil
+	default: // MediaTypeKindConfig, MediaTypeKindLayer
+		return nil, nil
+	}
+}
+
+// Walk walks the blob graph reachable from descriptor (inclusive), calling
+// walkFunc once for every descriptor encountered in a pre-order,
+// depth-first traversal.
+//
+// Whether Walk recurses into a descriptor's children -- and how it decodes
+// them -- is decided by the descriptor's MediaTypeKind (see
+// RegisterMediaType), not a hardcoded switch over the OCI media type
+// constants. This means Docker v2 manifests and manifest lists (which are
+// registered as MediaTypeKindManifest and MediaTypeKindIndex respectively)
+// are walked exactly like their OCI equivalents, as are any media types a
+// downstream project has registered.
+//
+// If walkFunc returns ErrSkipDescriptor, Walk does not recurse into that
+// descriptor's children, but the walk otherwise continues normally. Any
+// other non-nil error aborts the walk and is returned to the caller of
+// Walk.
+func (e Engine) Walk(ctx context.Context, descriptor ispec.Descriptor, walkFunc WalkFunc) error {
+	if err := walkFunc(descriptor); err != nil {
+		if errors.Cause(err) == ErrSkipDescriptor {
+			return nil
+		}
+		return err
+	}
+
+	kind, ok := lookupMediaTypeKind(descriptor.MediaType)
+	if !ok {
+		// Forward-compatible/unknown media types have no known shape to
+		// decode children from -- treat them as terminal.
+		return nil
+	}
+	if kind == MediaTypeKindConfig || kind == MediaTypeKindLayer {
+		// walkChildren never returns any children for these kinds -- avoid
+		// fetching (and verifying) the full blob just to discard it. This
+		// matters in practice: layer blobs can be gigabytes in size.
+		return nil
+	}
+
+	blob, err := fetchBlob(ctx, e, descriptor)
+	if err != nil {
+		return err
+	}
+
+	children, err := walkChildren(kind, blob)
+	if err != nil {
+		return errors.Wrapf(err, "decode children of %s", descriptor.Digest)
+	}
+	for _, child := range children {
+		if err := e.Walk(ctx, child, walkFunc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// TestWalkChildrenDockerManifestList verifies that a Docker v2 manifest
+// list is decoded exactly like an OCI image index -- i.e. that
+// MediaTypeDockerV2ManifestList being registered as MediaTypeKindIndex
+// actually causes its "manifests" array to be descended into, rather than
+// the registration being inert.
+func TestWalkChildrenDockerManifestList(t *testing.T) {
+	amd64 := ispec.Descriptor{
+		MediaType: MediaTypeDockerV2Manifest,
+		Digest:    "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		Size:      123,
+		Platform:  &ispec.Platform{OS: "linux", Architecture: "amd64"},
+	}
+	arm64 := ispec.Descriptor{
+		MediaType: MediaTypeDockerV2Manifest,
+		Digest:    "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+		Size:      124,
+		Platform:  &ispec.Platform{OS: "linux", Architecture: "arm64"},
+	}
+
+	blob, err := json.Marshal(indexChildren{Manifests: []ispec.Descriptor{amd64, arm64}})
+	if err != nil {
+		t.Fatalf("marshal manifest list: %v", err)
+	}
+
+	kind, ok := lookupMediaTypeKind(MediaTypeDockerV2ManifestList)
+	if !ok || kind != MediaTypeKindIndex {
+		t.Fatalf("expected %s to be registered as MediaTypeKindIndex, got %v (registered=%v)", MediaTypeDockerV2ManifestList, kind, ok)
+	}
+
+	children, err := walkChildren(kind, blob)
+	if err != nil {
+		t.Fatalf("walkChildren: %v", err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("expected 2 children, got %d", len(children))
+	}
+	if children[0].Digest != amd64.Digest || children[1].Digest != arm64.Digest {
+		t.Fatalf("children did not match the manifest list entries: %+v", children)
+	}
+}
+
+// TestWalkChildrenDockerManifest verifies that a Docker v2 manifest's
+// config and layers are found the same way as an OCI image manifest's.
+func TestWalkChildrenDockerManifest(t *testing.T) {
+	config := ispec.Descriptor{MediaType: MediaTypeDockerV2ImageConfig, Digest: "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", Size: 10}
+	layer := ispec.Descriptor{MediaType: MediaTypeDockerV2Layer, Digest: "sha256:dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd", Size: 20}
+
+	blob, err := json.Marshal(manifestChildren{Config: config, Layers: []ispec.Descriptor{layer}})
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+
+	children, err := walkChildren(MediaTypeKindManifest, blob)
+	if err != nil {
+		t.Fatalf("walkChildren: %v", err)
+	}
+	if len(children) != 2 || children[0].Digest != config.Digest || children[1].Digest != layer.Digest {
+		t.Fatalf("unexpected children: %+v", children)
+	}
+}
+
+// TestEngineWalkDescendsDockerManifestList drives Engine.Walk end-to-end
+// over a real Docker v2 manifest list, proving that the MediaTypeKindIndex
+// registration for MediaTypeDockerV2ManifestList actually causes Walk to
+// fetch and descend into it (rather than that registration being inert),
+// and that the per-platform Docker v2 manifests underneath are reached in
+// turn -- without ever fetching their layer blobs, which are never written
+// to the store here.
+func TestEngineWalkDescendsDockerManifestList(t *testing.T) {
+	e := newTestEngine(t)
+	ctx := context.Background()
+
+	missingLayer := ispec.Descriptor{
+		MediaType: MediaTypeDockerV2Layer,
+		Digest:    "sha256:eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee",
+		Size:      123456789,
+	}
+	config := e.putBlobJSON(t, MediaTypeDockerV2ImageConfig, struct{}{})
+
+	amd64 := e.putBlobJSON(t, MediaTypeDockerV2Manifest, manifestChildren{
+		Config: config,
+		Layers: []ispec.Descriptor{missingLayer},
+	})
+	amd64.MediaType = MediaTypeDockerV2Manifest
+	amd64.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	manifestList := e.putBlobJSON(t, MediaTypeDockerV2ManifestList, indexChildren{
+		Manifests: []ispec.Descriptor{amd64},
+	})
+	manifestList.MediaType = MediaTypeDockerV2ManifestList
+
+	var visited []ispec.Descriptor
+	if err := e.Walk(ctx, manifestList, func(descriptor ispec.Descriptor) error {
+		visited = append(visited, descriptor)
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	// The layer descriptor is visited (walkFunc is called for it, like any
+	// other child) but its blob is never fetched -- if it were, Walk would
+	// have failed above, since missingLayer was never written to the store.
+	if len(visited) != 4 {
+		t.Fatalf("expected to visit the manifest list, its manifest, its config and its layer, got %+v", visited)
+	}
+	if visited[0].Digest != manifestList.Digest || visited[1].Digest != amd64.Digest ||
+		visited[2].Digest != config.Digest || visited[3].Digest != missingLayer.Digest {
+		t.Fatalf("unexpected pre-order traversal: %+v", visited)
+	}
+}
+
+// TestWalkChildrenTerminal verifies that config and layer blobs -- which
+// cannot reference further children -- are treated as terminal without
+// attempting to decode them.
+func TestWalkChildrenTerminal(t *testing.T) {
+	for _, kind := range []MediaTypeKind{MediaTypeKindConfig, MediaTypeKindLayer} {
+		children, err := walkChildren(kind, []byte("not even json"))
+		if err != nil {
+			t.Fatalf("walkChildren(%v): unexpected error: %v", kind, err)
+		}
+		if children != nil {
+			t.Fatalf("walkChildren(%v): expected no children, got %+v", kind, children)
+		}
+	}
+}